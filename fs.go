@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// FS abstracts the filesystem operations run and convert need, so that
+// -src/-dst can point somewhere other than a local directory. It mirrors
+// io/fs.FS plus the handful of write operations a sync tool needs.
+type FS interface {
+	Mkdir(path string, perm os.FileMode) error
+	Create(path string) (io.WriteCloser, error)
+	Open(path string) (io.ReadCloser, error)
+	Rename(oldPath, newPath string) error
+	Remove(path string) error
+	Stat(path string) (os.FileInfo, error)
+	Walk(root string, fn filepath.WalkFunc) error
+}
+
+// dialFS resolves a -src/-dst flag value into an FS and the root path on
+// it. A bare path or a file:// URL is local; other schemes select a remote
+// backend, e.g. sftp://user@host/Music.
+func dialFS(spec string) (FS, string, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" {
+		return localFS{}, spec, nil
+	}
+	switch u.Scheme {
+	case "sftp":
+		return dialSFTP(u)
+	default:
+		return nil, "", errors.New("unsupported -src/-dst scheme " + u.Scheme)
+	}
+}
+
+// localFS implements FS directly against the local filesystem, preserving
+// the tool's original on-disk behavior, including falling back to
+// copy+unlink on a cross-device rename (common with MTP mounts).
+type localFS struct{}
+
+func (localFS) Mkdir(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (localFS) Create(path string) (io.WriteCloser, error) {
+	return os.Create(path)
+}
+
+func (localFS) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localFS) Rename(oldPath, newPath string) error {
+	return renameCrossDevice(oldPath, newPath)
+}
+
+func (localFS) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localFS) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (localFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+// localScratchDir returns a directory to stage ffmpeg output in before it's
+// handed off to dst, which is dstRoot itself for a local destination, or a
+// subdirectory of the OS temp dir unique to dstSpec for a remote one. The
+// per-destination subdirectory, rather than the bare OS temp dir, keeps two
+// concurrent musicsync invocations syncing different destinations from
+// sweeping or colliding with each other's in-flight scratch files.
+func localScratchDir(dstFS FS, dstSpec, dstRoot string) (string, error) {
+	if _, ok := dstFS.(localFS); ok {
+		return dstRoot, nil
+	}
+	dir := filepath.Join(os.TempDir(), "musicsync-"+scratchDirFingerprint(dstSpec))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// scratchDirFingerprint derives a stable, filesystem-safe directory name
+// from a -dst spec, the same way encoderArgsFingerprint hashes flags.
+func scratchDirFingerprint(dstSpec string) string {
+	h, _ := blake2b.New256(nil)
+	io.WriteString(h, dstSpec)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isLocalFS(f FS) bool {
+	_, ok := f.(localFS)
+	return ok
+}
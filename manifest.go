@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// readAll reads the whole file at path on fsys, returning (nil, notExistErr)
+// style semantics compatible with os.IsNotExist.
+func readAll(fsys FS, path string) ([]byte, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+const manifestFileName = ".musicsync.json"
+
+// manifestEntry records enough about one converted file for run to decide,
+// on a later invocation, whether it needs to be re-encoded.
+type manifestEntry struct {
+	SrcHash  string `json:"src_hash"`
+	SrcSize  int64  `json:"src_size"`
+	SrcMtime int64  `json:"src_mtime"`
+	ArgsHash string `json:"args_hash"`
+	DstPath  string `json:"dst_path"`
+	DstHash  string `json:"dst_hash"`
+}
+
+// manifest is a content-addressed record of conversions, keyed by the
+// relative source path, persisted as JSON at the destination root.
+type manifest struct {
+	Entries map[string]manifestEntry `json:"entries"`
+}
+
+func loadManifest(dstFS FS, dstDir string) (*manifest, error) {
+	b, err := readAll(dstFS, filepath.Join(dstDir, manifestFileName))
+	if os.IsNotExist(err) {
+		return &manifest{Entries: map[string]manifestEntry{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m.Entries == nil {
+		m.Entries = map[string]manifestEntry{}
+	}
+	return &m, nil
+}
+
+// save writes the manifest to dstDir atomically, via a temp file plus
+// rename, so a crash mid-write can't corrupt the previous manifest.
+func (m *manifest) save(dstFS FS, dstDir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dstDir, manifestFileName+".tmp")
+	tf, err := dstFS.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := tf.Write(b); err != nil {
+		tf.Close()
+		dstFS.Remove(tmpPath)
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		dstFS.Remove(tmpPath)
+		return err
+	}
+	return dstFS.Rename(tmpPath, filepath.Join(dstDir, manifestFileName))
+}
+
+// hashFile streams path through BLAKE2b-256 without holding the whole file
+// in memory, so it's cheap to run concurrently alongside the ffmpeg jobs.
+func hashFile(fsys FS, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// encoderArgsFingerprint hashes the flags that affect the ffmpeg invocation,
+// so changing -tags, -cover, or -replaygain invalidates the manifest without
+// needing to touch every entry by hand.
+func encoderArgsFingerprint(profileName string) string {
+	h, _ := blake2b.New256(nil)
+	io.WriteString(h, profileName+"|"+*tagMode+"|"+*coverMode+"|"+*replayGainMode)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func fileExists(fsys FS, path string) bool {
+	_, err := fsys.Stat(path)
+	return err == nil
+}
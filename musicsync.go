@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -15,106 +16,215 @@ import (
 )
 
 var (
-	srcDir = flag.String("src", "", "Source directory")
-	dstDir = flag.String("dst", "./", "Destination directory")
+	srcDir = flag.String("src", "", "Source directory, e.g. /Music or sftp://user@host/Music")
+	dstDir = flag.String("dst", "./", "Destination directory, e.g. /mnt/phone or sftp://user@host/Music")
 	dryRun = flag.Bool("dry", true, "Dry run")
 	// This is needed to run on MTP mounted devices, which don't support move.
 	useTempFile = flag.Bool("tempfile", true, "Use a temp file for atomic moves")
+
+	tagMode        = flag.String("tags", "copy", "How to handle source tags: copy|strip")
+	coverMode      = flag.String("cover", "embed", "How to handle cover art: embed|folder|none")
+	replayGainMode = flag.String("replaygain", "off", "ReplayGain computation: track|album|off")
+
+	prune = flag.Bool("prune", false, "Remove destination files whose source no longer exists")
 )
 
-func run(inctx context.Context, srcDir, dstDir string, dry bool) error {
-	if fi, err := os.Stat(srcDir); err != nil {
+func run(inctx context.Context, srcSpec, dstSpec string, dry bool) error {
+	srcFS, srcRoot, err := dialFS(srcSpec)
+	if err != nil {
+		return err
+	}
+	dstFS, dstRoot, err := dialFS(dstSpec)
+	if err != nil {
+		return err
+	}
+
+	if fi, err := srcFS.Stat(srcRoot); err != nil {
 		return err
 	} else if !fi.Mode().IsDir() {
-		return errors.New("Src " + srcDir + " is not a dir")
+		return errors.New("Src " + srcSpec + " is not a dir")
 	}
-	if fi, err := os.Stat(dstDir); err != nil {
+	if fi, err := dstFS.Stat(dstRoot); err != nil {
 		return err
 	} else if !fi.Mode().IsDir() {
-		return errors.New("Dst " + dstDir + " is not a dir")
+		return errors.New("Dst " + dstSpec + " is not a dir")
+	}
+	scratchDir, err := localScratchDir(dstFS, dstSpec, dstRoot)
+	if err != nil {
+		return err
+	}
+
+	if !dry {
+		if err := sweepIncomplete(dstFS, dstRoot, scratchDir); err != nil {
+			return err
+		}
+	}
+
+	man, err := loadManifest(dstFS, dstRoot)
+	if err != nil {
+		return err
+	}
+	var manifestMu sync.Mutex
+	seen := map[string]bool{}
+
+	defProfile, err := profileByName(*profileName)
+	if err != nil {
+		return err
+	}
+	profileOverrides, err := parseProfileMap(*profileMap)
+	if err != nil {
+		return err
+	}
+
+	fileRules, dirRules, err := loadRules()
+	if err != nil {
+		return err
 	}
 
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(inctx)
 	lim := make(chan struct{}, 8)
 	convertErrs := make(chan error, 8)
-	err := filepath.Walk(srcDir, func(srcPath string, sfi os.FileInfo, prevErr error) error {
+	var albumsMu sync.Mutex
+	albums := map[string][]albumTrack{}
+	err = srcFS.Walk(srcRoot, func(srcPath string, sfi os.FileInfo, prevErr error) error {
 		if prevErr != nil {
 			return prevErr
 		}
 
 		var err error
+		relSrcPath, err := filepath.Rel(srcRoot, srcPath)
+		if err != nil {
+			return err
+		}
+		if relSrcPath == "." {
+			return nil
+		}
+
+		if sfi.Mode().IsDir() {
+			if !included(dirRules, relSrcPath, true) {
+				log.Println("Skipping dir " + relSrcPath)
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if !sfi.Mode().IsRegular() {
 			return nil
 		}
-		relSrcPath, err := filepath.Rel(srcDir, srcPath)
-		if err != nil {
-			return err
+		if !included(fileRules, relSrcPath, false) {
+			// Default rules alone exclude every cover.jpg/.nfo/.cue the
+			// walk crosses, so logging those would just be spam and
+			// wouldn't reproduce today's quiet behavior. But once the
+			// user has their own -include/-exclude/-rules-file rules in
+			// play, log the exclusion: that's the case where a typo'd
+			// rule silently dropping a wanted file needs to be visible.
+			if len(dirRules) > 0 {
+				log.Println("Ignoring " + relSrcPath)
+			}
+			return nil
 		}
-		dstPathOldExt := filepath.Join(dstDir, relSrcPath)
+
+		dstPathOldExt := filepath.Join(dstRoot, relSrcPath)
 		oldExt := filepath.Ext(dstPathOldExt)
 		lowerOldExt := strings.ToLower(oldExt)
-		switch lowerOldExt {
-		case ".mp3":
-		case ".mp4":
-		case ".flac":
-		case ".wma":
-		case ".ogg":
-		case ".opus":
-		case ".m4b":
-		case ".webm":
-		case ".wav":
-		case ".mkv":
-
-		default:
-			switch lowerOldExt {
-			case ".jpg":
-			case ".jpeg":
-			case ".png":
-			case ".cue":
-			case ".nfo":
-			case ".pdf":
-			case ".db":
-			case ".bmp":
-			case ".m3u":
-			case ".md5":
-			case ".lnk":
-			case ".gif":
-			case ".htm":
-			case ".url":
-			case ".log":
-			case ".ini":
-			case ".txt":
-			case ".sfv":
-			default:
-				log.Println("Ignoring " + relSrcPath)
-			}
 
-			return nil
+		profile, err := profileFor(lowerOldExt, profileOverrides, defProfile)
+		if err != nil {
+			return err
 		}
 
-		dstPath := strings.TrimSuffix(dstPathOldExt, oldExt) + ".mp3"
+		dstPath := strings.TrimSuffix(dstPathOldExt, oldExt) + profile.Ext()
 		// FAT32 limitations:
 		dstPath = strings.Replace(dstPath, "?", "_ques_", -1)
 
-		if _, err := os.Stat(dstPath); os.IsNotExist(err) {
+		manifestMu.Lock()
+		seen[relSrcPath] = true
+		manifestMu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case lim <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			srcHash, hashErr := hashFile(srcFS, srcPath)
+			<-lim
+			if hashErr != nil {
+				cancel()
+				select {
+				case convertErrs <- hashErr:
+				default:
+				}
+				return
+			}
+
+			argsHash := encoderArgsFingerprint(profile.Name())
+			manifestMu.Lock()
+			entry, ok := man.Entries[relSrcPath]
+			manifestMu.Unlock()
+			upToDate := ok && entry.SrcHash == srcHash && entry.ArgsHash == argsHash && fileExists(dstFS, dstPath)
+
+			// Register every synced track for album ReplayGain, not just
+			// the ones this run re-encodes, so a rerun that only touches
+			// one track out of an album still computes
+			// REPLAYGAIN_ALBUM_GAIN from the whole album instead of just
+			// that track.
+			if *replayGainMode == "album" {
+				albumsMu.Lock()
+				albumDir := filepath.Dir(dstPath)
+				albums[albumDir] = append(albums[albumDir], albumTrack{path: dstPath, profile: profile})
+				albumsMu.Unlock()
+			}
+
+			if upToDate {
+				return
+			}
+
 			log.Println("Starting " + dstPath)
-			if !dry {
-				wg.Add(1)
-				go func() {
-					if err := convert(ctx, srcPath, dstPath, dstDir, lim); err != nil {
-						cancel()
-						select {
-						case convertErrs <- err:
-						default:
-						}
-					}
-					wg.Done()
-				}()
+			if dry {
+				return
 			}
-		} else if err != nil {
-			return err
-		}
+			if err := convert(ctx, srcFS, srcPath, dstFS, dstPath, scratchDir, profile, lowerOldExt, lim); err != nil {
+				cancel()
+				select {
+				case convertErrs <- err:
+				default:
+				}
+				return
+			}
+
+			dstHash, err := hashFile(dstFS, dstPath)
+			if err != nil {
+				cancel()
+				select {
+				case convertErrs <- err:
+				default:
+				}
+				return
+			}
+			relDstPath, err := filepath.Rel(dstRoot, dstPath)
+			if err != nil {
+				cancel()
+				select {
+				case convertErrs <- err:
+				default:
+				}
+				return
+			}
+			manifestMu.Lock()
+			man.Entries[relSrcPath] = manifestEntry{
+				SrcHash:  srcHash,
+				SrcSize:  sfi.Size(),
+				SrcMtime: sfi.ModTime().Unix(),
+				ArgsHash: argsHash,
+				DstPath:  relDstPath,
+				DstHash:  dstHash,
+			}
+			manifestMu.Unlock()
+		}()
 
 		return nil
 	})
@@ -127,10 +237,45 @@ func run(inctx context.Context, srcDir, dstDir string, dry bool) error {
 		return err
 	default:
 	}
+	if !dry && *replayGainMode == "album" {
+		if !isLocalFS(dstFS) {
+			log.Println("Skipping album ReplayGain: destination is not local")
+		} else {
+			for _, tracks := range albums {
+				if err := applyAlbumReplayGain(ctx, tracks); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for relSrcPath, entry := range man.Entries {
+		if seen[relSrcPath] {
+			continue
+		}
+		log.Println("Orphan destination " + entry.DstPath)
+		if !dry && *prune {
+			dstPath := filepath.Join(dstRoot, entry.DstPath)
+			if err := dstFS.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(man.Entries, relSrcPath)
+		}
+	}
+
+	if !dry {
+		if err := man.save(dstFS, dstRoot); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func convert(ctx context.Context, srcPath, dstPath, dstRootDir string, lim chan struct{}) error {
+// convert transcodes srcPath (read through srcFS) to dstPath (written
+// through dstFS). ffmpeg only understands local files, so a non-local
+// source is staged into scratchDir first, and the encoded result always
+// lands in scratchDir before being handed to dstFS to finalize.
+func convert(ctx context.Context, srcFS FS, srcPath string, dstFS FS, dstPath, scratchDir string, profile Profile, srcExt string, lim chan struct{}) error {
 	select {
 	case lim <- struct{}{}:
 	case <-ctx.Done():
@@ -139,12 +284,24 @@ func convert(ctx context.Context, srcPath, dstPath, dstRootDir string, lim chan
 	defer func() {
 		<-lim
 	}()
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0775); err != nil {
+	if err := dstFS.Mkdir(filepath.Dir(dstPath), 0775); err != nil {
+		return err
+	}
+
+	localSrc, cleanupSrc, err := localize(srcFS, srcPath, scratchDir)
+	if err != nil {
 		return err
 	}
-	var dst string
-	if *useTempFile {
-		tf, err := ioutil.TempFile(dstRootDir, "converting")
+	defer cleanupSrc()
+
+	if profile.Passthrough(srcExt) {
+		return passthroughCopy(localSrc, dstFS, dstPath)
+	}
+
+	local := isLocalFS(dstFS)
+	var scratchPath string
+	if *useTempFile || !local {
+		tf, err := ioutil.TempFile(scratchDir, "converting")
 		if err != nil {
 			return err
 		}
@@ -152,18 +309,50 @@ func convert(ctx context.Context, srcPath, dstPath, dstRootDir string, lim chan
 			return err
 		}
 		defer os.Remove(tf.Name())
-		dst = tf.Name()
+		scratchPath = tf.Name()
 	} else {
-		dst = dstPath
+		scratchPath = dstPath
 	}
 
-	args := []string{
-		"-i", srcPath,
-		"-codec:a", "libmp3lame",
-		"-q:a", "0",
-		"-f", "mp3",
-		"-y",
-		dst,
+	args := []string{"-i", localSrc}
+
+	switch *tagMode {
+	case "strip":
+		args = append(args, "-map_metadata", "-1")
+	case "copy":
+		args = append(args, "-map_metadata", "0")
+	default:
+		return errors.New("unknown -tags mode " + *tagMode)
+	}
+
+	switch *coverMode {
+	case "embed":
+		if profile.SupportsAttachedPic() {
+			args = append(args, "-map", "0:a", "-map", "0:v?", "-c:v", "copy", "-disposition:v", "attached_pic")
+		} else {
+			log.Println("Profile " + profile.Name() + " can't embed cover art, dropping it for " + localSrc)
+			args = append(args, "-map", "0:a")
+		}
+	case "folder", "none":
+		args = append(args, "-map", "0:a")
+	default:
+		return errors.New("unknown -cover mode " + *coverMode)
+	}
+
+	args = append(args, profile.Args()...)
+
+	if profile.Ext() == ".mp3" {
+		args = append(args, "-id3v2_version", "3")
+	}
+
+	if *replayGainMode == "track" {
+		args = append(args, "-af", "loudnorm")
+	}
+
+	args = append(args, "-f", profile.Container(), "-y", scratchPath)
+
+	if err := markPartial(dstFS, dstPath); err != nil {
+		return err
 	}
 
 	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
@@ -175,13 +364,45 @@ func convert(ctx context.Context, srcPath, dstPath, dstRootDir string, lim chan
 		return err
 	}
 
-	if *useTempFile {
-		if err := os.Rename(dst, dstPath); err != nil {
+	if *coverMode == "folder" && !local {
+		log.Println("-cover=folder is not supported for a remote dst, skipping cover art for", localSrc)
+	} else if *coverMode == "folder" {
+		// extractFolderCover writes straight to the local filesystem, at
+		// dstPath's own directory (the album dir) so every album gets its
+		// own cover.jpg instead of every album racing to write (and
+		// "already exists"-skip) the same shared scratch-dir file.
+		if err := extractFolderCover(ctx, localSrc, filepath.Dir(dstPath)); err != nil {
+			log.Println("Failed to extract cover art for", localSrc, ":", err)
+		}
+	}
+
+	if *replayGainMode == "track" {
+		gain, err := measureReplayGain(ctx, scratchPath)
+		if err != nil {
+			return err
+		}
+		if err := writeReplayGainTags(ctx, scratchPath, profile, map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": gain.trackGain(),
+		}); err != nil {
 			return err
 		}
 	}
 
-	if fi, err := os.Stat(dstPath); err != nil {
+	if scratchPath != dstPath {
+		if local {
+			if err := dstFS.Rename(scratchPath, dstPath); err != nil {
+				return err
+			}
+		} else if err := uploadFile(dstFS, scratchPath, dstPath); err != nil {
+			return err
+		}
+	}
+
+	if err := clearPartial(dstFS, dstPath); err != nil {
+		return err
+	}
+
+	if fi, err := dstFS.Stat(dstPath); err != nil {
 		return err
 	} else {
 		log.Println("Finished", fi.Name())
@@ -190,6 +411,106 @@ func convert(ctx context.Context, srcPath, dstPath, dstRootDir string, lim chan
 	return nil
 }
 
+// passthroughCopy is used when the source is already in the target
+// profile's format, so there's no need to spend ffmpeg re-encoding it.
+func passthroughCopy(localSrc string, dstFS FS, dstPath string) error {
+	if err := markPartial(dstFS, dstPath); err != nil {
+		return err
+	}
+
+	if isLocalFS(dstFS) {
+		if err := os.Link(localSrc, dstPath); err != nil {
+			if err := copyFile(localSrc, dstPath); err != nil {
+				return err
+			}
+		}
+	} else if err := uploadFile(dstFS, localSrc, dstPath); err != nil {
+		return err
+	}
+
+	if err := clearPartial(dstFS, dstPath); err != nil {
+		return err
+	}
+
+	if fi, err := dstFS.Stat(dstPath); err != nil {
+		return err
+	} else {
+		log.Println("Finished", fi.Name())
+	}
+	return nil
+}
+
+// localize returns a local path to read srcPath from, staging a copy in
+// scratchDir first when srcFS isn't the local filesystem. The returned
+// cleanup func must always be called.
+func localize(srcFS FS, srcPath, scratchDir string) (string, func(), error) {
+	if isLocalFS(srcFS) {
+		return srcPath, func() {}, nil
+	}
+	tf, err := ioutil.TempFile(scratchDir, "srcstage")
+	if err != nil {
+		return "", nil, err
+	}
+	in, err := srcFS.Open(srcPath)
+	if err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return "", nil, err
+	}
+	_, copyErr := io.Copy(tf, in)
+	in.Close()
+	closeErr := tf.Close()
+	if copyErr != nil {
+		os.Remove(tf.Name())
+		return "", nil, copyErr
+	}
+	if closeErr != nil {
+		os.Remove(tf.Name())
+		return "", nil, closeErr
+	}
+	return tf.Name(), func() { os.Remove(tf.Name()) }, nil
+}
+
+// uploadFile copies the local file at localPath to dstPath on dstFS, for
+// the case where the encoded result was staged in a local scratch dir
+// because dstFS is remote.
+func uploadFile(dstFS FS, localPath, dstPath string) error {
+	in, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := dstFS.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func copyFile(srcPath, dstPath string) error {
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
 func main() {
 	flag.Parse()
 	if err := run(context.Background(), *srcDir, *dstDir, *dryRun); err != nil {
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+)
+
+var (
+	profileName = flag.String("profile", "mp3-v0", "Output profile: mp3-v0|mp3-cbr|opus-voip|opus-music|aac-m4a|flac-passthrough")
+	profileMap  = flag.String("profile-map", "", "Comma-separated src-ext=profile overrides, e.g. .m4b=opus-voip,.flac=opus-music")
+)
+
+// Profile describes one output encoding target: the container it produces,
+// the ffmpeg args needed to produce it, and whether a given source can be
+// used as-is without transcoding at all.
+type Profile interface {
+	// Name is the identifier used on the -profile and -profile-map flags.
+	Name() string
+	// Ext is the destination file extension, including the leading dot.
+	Ext() string
+	// Container is the ffmpeg -f muxer name for Ext.
+	Container() string
+	// Args returns the profile's codec args, to be appended after the
+	// tag/cover-handling args convert already builds.
+	Args() []string
+	// Passthrough reports whether a file with the given (lowercased)
+	// source extension is already in this profile's format, so convert
+	// can copy/link it instead of invoking ffmpeg.
+	Passthrough(srcExt string) bool
+	// SupportsAttachedPic reports whether this profile's container can
+	// hold an attached-picture video stream the way the mp3/mp4 muxers
+	// do. ffmpeg's ogg muxer (opus-voip, opus-music) rejects one outright.
+	SupportsAttachedPic() bool
+}
+
+type codecProfile struct {
+	name        string
+	ext         string
+	container   string
+	args        []string
+	passExt     string
+	attachedPic bool
+}
+
+func (p codecProfile) Name() string              { return p.name }
+func (p codecProfile) Ext() string               { return p.ext }
+func (p codecProfile) Container() string         { return p.container }
+func (p codecProfile) Args() []string            { return p.args }
+func (p codecProfile) SupportsAttachedPic() bool { return p.attachedPic }
+func (p codecProfile) Passthrough(srcExt string) bool {
+	return p.passExt != "" && srcExt == p.passExt
+}
+
+var profiles = map[string]Profile{
+	"mp3-v0": codecProfile{
+		name: "mp3-v0", ext: ".mp3", container: "mp3",
+		args: []string{"-codec:a", "libmp3lame", "-q:a", "0"}, attachedPic: true,
+	},
+	"mp3-cbr": codecProfile{
+		name: "mp3-cbr", ext: ".mp3", container: "mp3",
+		args: []string{"-codec:a", "libmp3lame", "-b:a", "192k"}, attachedPic: true,
+	},
+	"opus-voip": codecProfile{
+		name: "opus-voip", ext: ".opus", container: "ogg",
+		args: []string{"-codec:a", "libopus", "-b:a", "32k", "-application", "voip", "-vbr", "on"},
+	},
+	"opus-music": codecProfile{
+		name: "opus-music", ext: ".opus", container: "ogg",
+		args: []string{"-codec:a", "libopus", "-b:a", "128k", "-application", "audio", "-vbr", "on"},
+	},
+	"aac-m4a": codecProfile{
+		name: "aac-m4a", ext: ".m4a", container: "ipod",
+		args: []string{"-codec:a", "aac", "-b:a", "256k"}, attachedPic: true,
+	},
+	"flac-passthrough": codecProfile{
+		name: "flac-passthrough", ext: ".flac", container: "flac",
+		args: []string{"-codec:a", "flac", "-compression_level", "8"}, passExt: ".flac",
+	},
+}
+
+func profileByName(name string) (Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return nil, errors.New("unknown profile " + name)
+	}
+	return p, nil
+}
+
+// parseProfileMap parses the -profile-map flag into a lowercased
+// source-extension to profile name lookup.
+func parseProfileMap(s string) (map[string]string, error) {
+	m := map[string]string{}
+	if s == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("malformed -profile-map entry " + pair)
+		}
+		ext := strings.ToLower(strings.TrimSpace(kv[0]))
+		name := strings.TrimSpace(kv[1])
+		if _, err := profileByName(name); err != nil {
+			return nil, err
+		}
+		m[ext] = name
+	}
+	return m, nil
+}
+
+// profileFor picks the Profile to use for a source file with the given
+// lowercased extension, consulting the -profile-map overrides first and
+// falling back to the default -profile.
+func profileFor(srcExt string, overrides map[string]string, def Profile) (Profile, error) {
+	if name, ok := overrides[srcExt]; ok {
+		return profileByName(name)
+	}
+	return def, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// referenceLoudness is the target loudness (LUFS) ReplayGain gain values are
+// computed against, per the EBU R128 based ReplayGain 2.0 proposal.
+const referenceLoudness = -18.0
+
+type loudness struct {
+	integrated float64 // LUFS
+	lra        float64 // LU
+}
+
+func (l loudness) trackGain() string {
+	return fmt.Sprintf("%.2f dB", referenceLoudness-l.integrated)
+}
+
+var ebur128Summary = regexp.MustCompile(`I:\s*(-?[\d.]+) LUFS.*?LRA:\s*([\d.]+) LU`)
+
+// measureReplayGain runs ffmpeg's ebur128 filter over dstPath and parses the
+// integrated loudness and loudness range out of its stderr summary.
+func measureReplayGain(ctx context.Context, dstPath string) (loudness, error) {
+	args := []string{
+		"-i", dstPath,
+		"-af", "ebur128=peak=true",
+		"-f", "null",
+		"-",
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	buf := &bytes.Buffer{}
+	cmd.Stderr = buf
+	if err := cmd.Run(); err != nil {
+		return loudness{}, err
+	}
+	m := ebur128Summary.FindSubmatch(bytes.Replace(buf.Bytes(), []byte("\n"), []byte(" "), -1))
+	if m == nil {
+		return loudness{}, errors.New("could not parse ebur128 summary for " + dstPath)
+	}
+	i, err := strconv.ParseFloat(string(m[1]), 64)
+	if err != nil {
+		return loudness{}, err
+	}
+	lra, err := strconv.ParseFloat(string(m[2]), 64)
+	if err != nil {
+		return loudness{}, err
+	}
+	return loudness{integrated: i, lra: lra}, nil
+}
+
+// albumTrack is one file awaiting album-level ReplayGain, along with the
+// Profile it was encoded with, so the tag-writing pass can target the
+// right container instead of assuming mp3.
+type albumTrack struct {
+	path    string
+	profile Profile
+}
+
+// applyAlbumReplayGain measures each track in an album together with the
+// album as a whole and writes REPLAYGAIN_TRACK_GAIN and
+// REPLAYGAIN_ALBUM_GAIN TXXX frames into every track.
+func applyAlbumReplayGain(ctx context.Context, tracks []albumTrack) error {
+	if len(tracks) == 0 {
+		return nil
+	}
+	trackLoudness := make([]loudness, len(tracks))
+	for i, t := range tracks {
+		l, err := measureReplayGain(ctx, t.path)
+		if err != nil {
+			return err
+		}
+		trackLoudness[i] = l
+	}
+
+	var sum float64
+	for _, l := range trackLoudness {
+		sum += l.integrated
+	}
+	album := loudness{integrated: sum / float64(len(trackLoudness))}
+	albumGain := fmt.Sprintf("%.2f dB", referenceLoudness-album.integrated)
+
+	for i, t := range tracks {
+		tags := map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": trackLoudness[i].trackGain(),
+			"REPLAYGAIN_ALBUM_GAIN": albumGain,
+		}
+		if err := writeReplayGainTags(ctx, t.path, t.profile, tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReplayGainTags rewrites dstPath in place, copying the audio and cover
+// art streams untouched while adding the given TXXX metadata frames. It
+// remuxes into profile's own container rather than assuming mp3, so a
+// non-mp3 profile doesn't end up with mp3 data under its extension.
+func writeReplayGainTags(ctx context.Context, dstPath string, profile Profile, tags map[string]string) error {
+	tf, err := ioutil.TempFile(filepath.Dir(dstPath), "replaygain")
+	if err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	args := []string{"-i", dstPath, "-map", "0", "-codec", "copy"}
+	for k, v := range tags {
+		args = append(args, "-metadata", k+"="+v)
+	}
+	if profile.Ext() == ".mp3" {
+		args = append(args, "-id3v2_version", "3")
+	}
+	args = append(args, "-f", profile.Container(), "-y", tf.Name())
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	buf := &bytes.Buffer{}
+	cmd.Stderr = buf
+	if err := cmd.Run(); err != nil {
+		log.Println("Failed to write ReplayGain tags\n", err, buf.String())
+		return err
+	}
+
+	return os.Rename(tf.Name(), dstPath)
+}
+
+// extractFolderCover pulls the first attached picture out of srcPath and
+// writes it as cover.jpg in albumDir, for players that prefer a folder-level
+// cover image over an embedded one.
+func extractFolderCover(ctx context.Context, srcPath, albumDir string) error {
+	coverPath := filepath.Join(albumDir, "cover.jpg")
+	if _, err := os.Stat(coverPath); err == nil {
+		return nil
+	}
+	args := []string{
+		"-i", srcPath,
+		"-map", "0:v?",
+		"-frames:v", "1",
+		"-y",
+		coverPath,
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	buf := &bytes.Buffer{}
+	cmd.Stderr = buf
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + ": " + buf.String())
+	}
+	if fi, err := os.Stat(coverPath); err != nil || fi.Size() == 0 {
+		os.Remove(coverPath)
+	}
+	return nil
+}
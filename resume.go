@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const partialSuffix = ".partial"
+
+// sweepIncomplete removes leftovers from a conversion that crashed or was
+// interrupted: orphaned "converting*"/"srcstage*" scratch files, and any
+// destination whose .partial marker proves it never finished, so a crash
+// doesn't leave stale temp files or silently-truncated destinations behind.
+// scratchDir is this run's own local scratch dir (see localScratchDir), so
+// the sweep never touches a different run's in-flight files.
+func sweepIncomplete(dstFS FS, dstRoot, scratchDir string) error {
+	if err := dstFS.Walk(dstRoot, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		base := filepath.Base(path)
+		switch {
+		case isScratchName(base):
+			log.Println("Removing orphaned temp file " + path)
+			return dstFS.Remove(path)
+		case strings.HasSuffix(path, partialSuffix):
+			dst := strings.TrimSuffix(path, partialSuffix)
+			log.Println("Removing incomplete conversion " + dst)
+			if err := dstFS.Remove(dst); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return dstFS.Remove(path)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// ffmpeg always stages its output locally, even for a remote dst, so
+	// also clean up anything left behind in this run's local scratch dir.
+	return sweepLocalScratch(scratchDir)
+}
+
+func sweepLocalScratch(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if fi.Mode().IsRegular() && isScratchName(fi.Name()) {
+			log.Println("Removing orphaned scratch file " + filepath.Join(dir, fi.Name()))
+			if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scratchPrefixes are the ioutil.TempFile prefixes this tool stages its own
+// scratch files under: the encode target (convert), the localized copy of a
+// remote source (localize), and the ReplayGain tag rewrite (writeReplayGainTags).
+var scratchPrefixes = []string{"converting", "srcstage", "replaygain"}
+
+// isScratchName reports whether base looks like one of this tool's own
+// scratch files rather than a library file that merely starts with the same
+// word: ioutil.TempFile always appends a purely numeric suffix to its
+// prefix, so "replaygain_backup.flac" or "srcstage-notes.txt" in a user's
+// library won't be mistaken for one and swept away.
+func isScratchName(base string) bool {
+	for _, prefix := range scratchPrefixes {
+		if rest := strings.TrimPrefix(base, prefix); rest != base && isDigits(rest) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// markPartial atomically creates a marker next to dstPath recording that a
+// conversion is in flight, so sweepIncomplete can detect and clean up a
+// crash on the next run.
+func markPartial(dstFS FS, dstPath string) error {
+	tf, err := ioutil.TempFile("", "partial")
+	if err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	return uploadFile(dstFS, tf.Name(), dstPath+partialSuffix)
+}
+
+func clearPartial(dstFS FS, dstPath string) error {
+	err := dstFS.Remove(dstPath + partialSuffix)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// renameCrossDevice behaves like os.Rename, but falls back to copy+unlink
+// when src and dst live on different filesystems (EXDEV), which happens
+// routinely when the destination is an MTP mount.
+func renameCrossDevice(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	linkErr, ok := err.(*os.LinkError)
+	if !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
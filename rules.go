@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+var rulesFile = flag.String("rules-file", "", "Path to a .musicsyncignore file with additional -include/-exclude rules")
+
+type ruleAction int
+
+const (
+	actionExclude ruleAction = iota
+	actionInclude
+)
+
+// rule is one -include/-exclude/.musicsyncignore line: a doublestar glob
+// matched against the source path relative to -src, plus the action to
+// take when it's the last rule to match.
+type rule struct {
+	pattern string
+	action  ruleAction
+}
+
+// cliRules accumulates -include and -exclude flags in the order they
+// appear on the command line, so last-match-wins semantics hold across
+// both flags rather than just within one of them.
+var cliRules []rule
+
+type ruleFlag ruleAction
+
+func (ruleFlag) String() string { return "" }
+
+// Set expands a slash-free pattern to match at any depth, the same as a
+// .musicsyncignore line, so the same glob behaves identically whether it
+// came from the CLI or the ignore file.
+func (a ruleFlag) Set(v string) error {
+	cliRules = append(cliRules, rule{pattern: anyDepthPattern(v), action: ruleAction(a)})
+	return nil
+}
+
+func init() {
+	flag.Var(ruleFlag(actionInclude), "include", "Glob of relative source paths to sync, doublestar-style; a pattern with no \"/\" matches at any depth, like gitignore (repeatable, last match wins)")
+	flag.Var(ruleFlag(actionExclude), "exclude", "Glob of relative source paths to skip, doublestar-style; a pattern with no \"/\" matches at any depth, like gitignore (repeatable, last match wins)")
+}
+
+// defaultAudioExts are the formats run has always transcoded.
+var defaultAudioExts = []string{".mp3", ".mp4", ".flac", ".wma", ".ogg", ".opus", ".m4b", ".webm", ".wav", ".mkv"}
+
+// defaultRules reproduces the extension-switch behavior this tool had
+// before the rule engine: exclude everything, then include the known
+// audio extensions.
+func defaultRules() []rule {
+	rules := []rule{{pattern: "**/*", action: actionExclude}}
+	for _, ext := range defaultAudioExts {
+		rules = append(rules, rule{pattern: "**/*" + ext, action: actionInclude})
+	}
+	return rules
+}
+
+// loadRulesFile parses a gitignore-style rules file: one glob per line,
+// blank lines and "#" comments ignored, a leading "!" negates a pattern
+// into an include rule. As in gitignore, a pattern with no "/" matches at
+// any depth, not just the source root, so it's expanded to a "**/" glob
+// before matchGlob ever sees it.
+func loadRulesFile(path string) ([]rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []rule
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action := actionExclude
+		if strings.HasPrefix(line, "!") {
+			action = actionInclude
+			line = line[1:]
+		}
+		rules = append(rules, rule{pattern: anyDepthPattern(line), action: action})
+	}
+	return rules, sc.Err()
+}
+
+// anyDepthPattern expands a slash-free gitignore-style pattern so it
+// matches at any depth, the same as a real .gitignore would. A pattern
+// that already contains a "/" is left alone, matching only relative to
+// the rules file's root exactly as written.
+func anyDepthPattern(pattern string) string {
+	if strings.Contains(pattern, "/") {
+		return pattern
+	}
+	return "**/" + pattern
+}
+
+// loadRules builds the rule sets used for the walk: fileRules decides
+// whether a regular file gets synced and starts from the built-in
+// extension-based defaults; dirRules is just the user-supplied overrides,
+// used to short-circuit a whole subtree with filepath.SkipDir, and leaves
+// directories the user never mentioned untouched.
+func loadRules() (fileRules, dirRules []rule, err error) {
+	overrides, err := loadRuleOverrides()
+	if err != nil {
+		return nil, nil, err
+	}
+	fileRules = append(defaultRules(), overrides...)
+	return fileRules, overrides, nil
+}
+
+// loadRuleOverrides returns the -rules-file rules followed by the
+// -include/-exclude flags, so CLI flags have the final say over a
+// checked-in ignore file.
+func loadRuleOverrides() ([]rule, error) {
+	var rules []rule
+	if *rulesFile != "" {
+		fileRules, err := loadRulesFile(*rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+	rules = append(rules, cliRules...)
+	return rules, nil
+}
+
+// matchGlob matches case-insensitively, since filenames on the FAT32/MTP
+// targets this tool writes to are routinely case-mangled.
+func matchGlob(pattern, relPath string) bool {
+	ok, err := doublestar.Match(strings.ToLower(pattern), strings.ToLower(filepath.ToSlash(relPath)))
+	return err == nil && ok
+}
+
+// included evaluates rules in order against relPath; the last matching
+// rule wins, which lets a narrow -include re-admit a path excluded by an
+// earlier, broader glob. defaultIncluded is the verdict when nothing
+// matches at all.
+func included(rules []rule, relPath string, defaultIncluded bool) bool {
+	result := defaultIncluded
+	for _, r := range rules {
+		if matchGlob(r.pattern, relPath) {
+			result = r.action == actionInclude
+		}
+	}
+	return result
+}